@@ -0,0 +1,118 @@
+//go:build !production
+
+// Package devmode lets a request relax the proxy's normal TLS and SSRF
+// guards against a single, explicitly named target host, for testing
+// against local/staging origins that run on self-signed certs or RFC1918
+// addresses. It is never activated by a plain flag: a caller must present a
+// short-lived token, HMAC-signed with a secret held in the Fastly secret
+// store, that binds the exact target hostname and an expiry. This mirrors
+// violet's selfCert bootstrap in spirit (an explicit, narrowly-scoped
+// opt-in) without trusting anything the caller merely asserts.
+//
+// Building with the "production" tag swaps this file out for a stub that
+// refuses every token unconditionally (see devmode_production.go), so dev
+// mode cannot be reached at all in a production build regardless of what
+// secret is configured.
+package devmode
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fastly/compute-sdk-go/secretstore"
+)
+
+// secretStoreName and secretName locate the HMAC signing key. Rotating the
+// key is just writing a new secret value; every previously issued token
+// becomes invalid immediately, which is the desired behavior for a
+// short-lived grant mechanism.
+const (
+	secretStoreName = "dynbackends"
+	secretName      = "dev_mode_hmac_key"
+)
+
+// ErrInvalidToken covers any structurally malformed or incorrectly signed
+// token. It is intentionally not distinguished from ErrExpired or
+// ErrHostMismatch at the handler level: whatever the reason, the request
+// just proceeds without dev mode rather than surfacing why.
+var ErrInvalidToken = errors.New("devmode: invalid token")
+
+// ErrExpired is returned by Verify for a validly signed token whose expiry
+// has passed.
+var ErrExpired = errors.New("devmode: token expired")
+
+// ErrHostMismatch is returned by Verify for a validly signed, unexpired
+// token issued for a different hostname than the one being requested.
+var ErrHostMismatch = errors.New("devmode: token does not authorize this host")
+
+// Verify checks that token is a validly signed, unexpired grant for
+// hostname. A nil return means the caller may enter dev mode for this
+// request; any error means it must not.
+func Verify(token, hostname string) error {
+	secret, err := loadSecret()
+	if err != nil {
+		return fmt.Errorf("devmode: %w", err)
+	}
+
+	payloadB64, sigB64, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadB64)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigB64)
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return ErrInvalidToken
+	}
+
+	tokenHost, expiry, err := parsePayload(string(payload))
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if time.Now().After(expiry) {
+		return ErrExpired
+	}
+	if !strings.EqualFold(tokenHost, hostname) {
+		return ErrHostMismatch
+	}
+	return nil
+}
+
+// parsePayload splits a payload of the form "<hostname>|<unix-expiry>".
+func parsePayload(payload string) (hostname string, expiry time.Time, err error) {
+	host, tsStr, ok := strings.Cut(payload, "|")
+	if !ok {
+		return "", time.Time{}, ErrInvalidToken
+	}
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return "", time.Time{}, ErrInvalidToken
+	}
+	return host, time.Unix(ts, 0), nil
+}
+
+func loadSecret() ([]byte, error) {
+	store, err := secretstore.Open(secretStoreName)
+	if err != nil {
+		return nil, fmt.Errorf("open secret store %q: %w", secretStoreName, err)
+	}
+	secret, err := store.Get(secretName)
+	if err != nil {
+		return nil, fmt.Errorf("read secret %q: %w", secretName, err)
+	}
+	return secret.Plaintext()
+}
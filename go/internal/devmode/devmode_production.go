@@ -0,0 +1,15 @@
+//go:build production
+
+package devmode
+
+import "errors"
+
+// ErrDisabled is returned by Verify for every token in a production build.
+// Dev mode has no code path to the secret store at all under this tag, so
+// there is no secret to rotate or misconfigure that would turn it back on.
+var ErrDisabled = errors.New("devmode: disabled in production builds")
+
+// Verify always refuses in a production build, regardless of token.
+func Verify(token, hostname string) error {
+	return ErrDisabled
+}
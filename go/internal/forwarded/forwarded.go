@@ -0,0 +1,115 @@
+// Package forwarded rewrites the client-identity headers that a reverse
+// proxy is expected to set on the way to an origin, instead of simply
+// stripping them. It follows the same shape as gorilla/handlers'
+// ProxyHeaders middleware: append to X-Forwarded-For rather than replacing
+// it, and set X-Forwarded-Host/-Proto/Forwarded from the incoming request.
+package forwarded
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Options controls which forwarded headers Rewrite sets, so operators can
+// opt in per-backend (for example via query parameters) instead of the
+// proxy imposing one fixed behavior on every origin.
+type Options struct {
+	// XForwardedFor controls whether X-Forwarded-For is set at all. When
+	// false, any inbound X-Forwarded-For is removed rather than forwarded.
+	XForwardedFor bool
+	// TrustInboundChain controls how XForwardedFor is populated: when
+	// true, ClientIP is appended to whatever X-Forwarded-For chain the
+	// client already sent, trusting that it was built by proxies ahead of
+	// us. When false (the default an operator should start from), any
+	// inbound chain is discarded and X-Forwarded-For is set to just
+	// ClientIP, since a direct client can put anything it likes in that
+	// header and there is no hop ahead of Fastly to have vetted it.
+	TrustInboundChain bool
+	// XForwardedHost sets X-Forwarded-Host to Host.
+	XForwardedHost bool
+	// XForwardedProto sets X-Forwarded-Proto to Proto.
+	XForwardedProto bool
+	// Forwarded sets the RFC 7239 Forwarded header from all three of the
+	// above.
+	Forwarded bool
+
+	// ClientIP is the immediate client's address, typically read from the
+	// Fastly-Client-IP header.
+	ClientIP string
+	// Host is the incoming request's Host header.
+	Host string
+	// Proto is the incoming request's scheme ("http" or "https").
+	Proto string
+}
+
+// Header is the minimal header interface Rewrite needs, satisfied by both
+// fsthttp.Header and net/http.Header.
+type Header interface {
+	Get(string) string
+	Set(string, string)
+	Del(string)
+}
+
+// Rewrite applies opts to header in place. Callers are expected to have
+// already deleted any inbound Host header themselves, since Host is not
+// part of Header on most request types.
+func Rewrite(header Header, opts Options) {
+	switch {
+	case !opts.XForwardedFor:
+		header.Del("X-Forwarded-For")
+	case opts.TrustInboundChain:
+		if existing := header.Get("X-Forwarded-For"); existing != "" && opts.ClientIP != "" {
+			header.Set("X-Forwarded-For", existing+", "+opts.ClientIP)
+		} else if opts.ClientIP != "" {
+			header.Set("X-Forwarded-For", opts.ClientIP)
+		}
+	case opts.ClientIP != "":
+		// Trust boundary override: ignore whatever chain the client sent
+		// and start a fresh one with only the address Fastly observed.
+		header.Set("X-Forwarded-For", opts.ClientIP)
+	default:
+		// No ClientIP to replace it with, and we don't trust the inbound
+		// chain: discard it rather than let whatever the client sent
+		// through untouched.
+		header.Del("X-Forwarded-For")
+	}
+
+	if opts.XForwardedHost && opts.Host != "" {
+		header.Set("X-Forwarded-Host", opts.Host)
+	}
+
+	if opts.XForwardedProto && opts.Proto != "" {
+		header.Set("X-Forwarded-Proto", opts.Proto)
+	}
+
+	if opts.Forwarded {
+		header.Set("Forwarded", buildForwarded(opts))
+	}
+}
+
+// buildForwarded renders the RFC 7239 Forwarded header value, e.g.
+// `for=203.0.113.5;host=example.com;proto=https`. Fields with no value are
+// omitted rather than rendered empty.
+func buildForwarded(opts Options) string {
+	var parts []string
+	if opts.ClientIP != "" {
+		parts = append(parts, fmt.Sprintf("for=%s", forwardedToken(opts.ClientIP)))
+	}
+	if opts.Host != "" {
+		parts = append(parts, fmt.Sprintf("host=%s", forwardedToken(opts.Host)))
+	}
+	if opts.Proto != "" {
+		parts = append(parts, fmt.Sprintf("proto=%s", forwardedToken(opts.Proto)))
+	}
+	return strings.Join(parts, ";")
+}
+
+// forwardedToken quotes a Forwarded header component if it contains
+// characters RFC 7239 requires to be quoted (notably ":" in IPv6
+// addresses and host:port pairs).
+func forwardedToken(v string) string {
+	if strings.ContainsAny(v, ":[]") {
+		return `"` + v + `"`
+	}
+	return v
+}
@@ -0,0 +1,109 @@
+package forwarded
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRewriteChainsExistingXFF(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "203.0.113.1")
+
+	Rewrite(header, Options{
+		XForwardedFor:     true,
+		TrustInboundChain: true,
+		ClientIP:          "203.0.113.2",
+	})
+
+	got := header.Get("X-Forwarded-For")
+	want := "203.0.113.1, 203.0.113.2"
+	if got != want {
+		t.Fatalf("X-Forwarded-For = %q, want %q", got, want)
+	}
+}
+
+func TestRewriteNoExistingXFF(t *testing.T) {
+	header := http.Header{}
+
+	Rewrite(header, Options{
+		XForwardedFor:     true,
+		TrustInboundChain: true,
+		ClientIP:          "203.0.113.2",
+	})
+
+	got := header.Get("X-Forwarded-For")
+	want := "203.0.113.2"
+	if got != want {
+		t.Fatalf("X-Forwarded-For = %q, want %q", got, want)
+	}
+}
+
+// TestRewriteTrustBoundaryOverride checks that, by default
+// (TrustInboundChain false), a client-supplied X-Forwarded-For is not
+// trusted or chained onto: the header is replaced with only the address
+// Fastly actually observed for this connection.
+func TestRewriteTrustBoundaryOverride(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "1.2.3.4") // spoofed by the client
+
+	Rewrite(header, Options{
+		XForwardedFor: true,
+		ClientIP:      "203.0.113.2",
+	})
+
+	got := header.Get("X-Forwarded-For")
+	if strings.Contains(got, "1.2.3.4") {
+		t.Fatalf("X-Forwarded-For = %q, should not contain the untrusted client-supplied value", got)
+	}
+	if got != "203.0.113.2" {
+		t.Fatalf("X-Forwarded-For = %q, want %q", got, "203.0.113.2")
+	}
+}
+
+// TestRewriteTrustBoundaryOverrideNoClientIP covers the same untrusted-chain
+// case as TestRewriteTrustBoundaryOverride but without a ClientIP to replace
+// it with: the inbound header must still be discarded, not passed through.
+func TestRewriteTrustBoundaryOverrideNoClientIP(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "1.2.3.4") // spoofed by the client
+
+	Rewrite(header, Options{
+		XForwardedFor: true,
+	})
+
+	if got := header.Get("X-Forwarded-For"); got != "" {
+		t.Fatalf("X-Forwarded-For = %q, want empty (untrusted chain discarded with no ClientIP to replace it)", got)
+	}
+}
+
+func TestRewriteXForwardedForDisabledStripsHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "1.2.3.4")
+
+	Rewrite(header, Options{
+		XForwardedFor: false,
+		ClientIP:      "203.0.113.2",
+	})
+
+	if got := header.Get("X-Forwarded-For"); got != "" {
+		t.Fatalf("X-Forwarded-For = %q, want empty when disabled", got)
+	}
+}
+
+func TestRewriteForwardedHeader(t *testing.T) {
+	header := http.Header{}
+
+	Rewrite(header, Options{
+		Forwarded: true,
+		ClientIP:  "203.0.113.2",
+		Host:      "example.com",
+		Proto:     "https",
+	})
+
+	got := header.Get("Forwarded")
+	want := "for=203.0.113.2;host=example.com;proto=https"
+	if got != want {
+		t.Fatalf("Forwarded = %q, want %q", got, want)
+	}
+}
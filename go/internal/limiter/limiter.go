@@ -0,0 +1,223 @@
+// Package limiter implements a per-key concurrency cap with a bounded FIFO
+// wait queue, analogous to gitlab-workhorse's APILimit/APIQueueLimit pairing.
+//
+// A Limiter hands out admission tickets for a key (in this proxy, the
+// sanitized backend name plus the API key, so one tenant hammering one
+// backend cannot starve another tenant or another backend). Once the
+// concurrent cap for a key is reached, further callers wait in a FIFO queue
+// up to QueueTimeout before being rejected. The queue itself is bounded too:
+// once QueueLimit waiters are already queued for a key, new callers are
+// rejected immediately instead of growing the queue further.
+//
+// IMPORTANT on Fastly Compute@Edge: this state lives in one Wasm instance's
+// memory, and the platform runs exactly one request per instance
+// (fsthttp.ServeFunc handles a single request and the instance is then
+// discarded). A Limiter therefore never observes more than one Acquire/
+// Release pair for a given key in its lifetime — it cannot cap concurrency
+// across requests, let alone across the fleet of instances actually serving
+// traffic. It is safe to keep using as the shape a *real*, shared limiter
+// would have (see the TODO on reqLimiter in main.go for what backing it with
+// actual shared state would take), but by itself it is not a working rate
+// limit; don't rely on it to stop a noisy tenant or a slow upstream.
+package limiter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRejected is returned when a key's wait queue is already full and the
+// caller was not admitted or queued at all.
+var ErrRejected = errors.New("limiter: queue full, request rejected")
+
+// ErrQueueTimeout is returned when a caller waited in the queue for longer
+// than QueueTimeout without being admitted.
+var ErrQueueTimeout = errors.New("limiter: timed out waiting in queue")
+
+// Config holds the tunable knobs for a Limiter.
+type Config struct {
+	// Limit is the maximum number of in-flight fetches permitted
+	// concurrently for a single key.
+	Limit int
+	// QueueLimit is the maximum number of callers allowed to wait for a
+	// slot at the same time. Additional callers are rejected immediately
+	// with ErrRejected.
+	QueueLimit int
+	// QueueTimeout is how long a queued caller waits for a slot before
+	// giving up with ErrQueueTimeout.
+	QueueTimeout time.Duration
+}
+
+// DefaultConfig mirrors gitlab-workhorse's historical defaults: a modest
+// concurrency cap with a short queue so bursts smooth out without holding
+// requests open indefinitely.
+var DefaultConfig = Config{
+	Limit:        20,
+	QueueLimit:   40,
+	QueueTimeout: 10 * time.Second,
+}
+
+// Limiter enforces Config per key. The zero value is not usable; construct
+// one with New.
+type Limiter struct {
+	cfg Config
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// bucket tracks the live state for a single key: how many callers are
+// currently running, and the FIFO of channels waiting for a slot.
+type bucket struct {
+	inFlight int
+	waiters  []chan struct{}
+}
+
+// New constructs a Limiter that enforces cfg for every key passed to
+// Acquire. A non-positive Limit or QueueTimeout falls back to the
+// corresponding field in DefaultConfig; a zero QueueLimit is honored as-is
+// (no queuing, only hard admission/rejection).
+func New(cfg Config) *Limiter {
+	if cfg.Limit <= 0 {
+		cfg.Limit = DefaultConfig.Limit
+	}
+	if cfg.QueueTimeout <= 0 {
+		cfg.QueueTimeout = DefaultConfig.QueueTimeout
+	}
+	return &Limiter{
+		cfg:     cfg,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Ticket represents an admitted slot. Callers must call Release exactly
+// once when the work it guards has finished.
+type Ticket struct {
+	l   *Limiter
+	key string
+}
+
+// Release frees the slot held by the ticket. If callers are waiting in the
+// queue for the same key, the longest-waiting one is admitted in its place.
+func (t *Ticket) Release() {
+	t.l.mu.Lock()
+	defer t.l.mu.Unlock()
+
+	b, ok := t.l.buckets[t.key]
+	if !ok {
+		return
+	}
+	t.l.freeSlotLocked(t.key, b)
+}
+
+// freeSlotLocked hands a just-freed slot for key to the longest-waiting
+// queued caller, or, if none are waiting, returns it to the pool (and drops
+// the bucket entirely once it's empty). Callers must hold l.mu.
+func (l *Limiter) freeSlotLocked(key string, b *bucket) {
+	if len(b.waiters) > 0 {
+		next := b.waiters[0]
+		b.waiters = b.waiters[1:]
+		next <- struct{}{}
+		return
+	}
+	b.inFlight--
+	if b.inFlight <= 0 {
+		delete(l.buckets, key)
+	}
+}
+
+// Status reports the occupancy observed for a key when Acquire admitted,
+// queued or rejected the caller (for a caller that had to wait, the moment
+// it joined the queue), used to populate the X-RateLimit-Remaining and
+// X-Queue-Depth response headers.
+type Status struct {
+	// Remaining is how many more concurrent fetches the key could start
+	// right now without queuing (never negative).
+	Remaining int
+	// QueueDepth is how many callers are waiting for a slot.
+	QueueDepth int
+}
+
+// Acquire blocks until a slot for key is available, the queue times out, or
+// ctx is canceled. On success it returns a Ticket that the caller must
+// Release, along with the Status observed at immediate admission or, if the
+// caller had to wait, when it joined the queue.
+//
+// If the key is already at Limit in-flight callers and the queue for that
+// key already holds QueueLimit waiters, Acquire returns ErrRejected
+// immediately without queuing. Otherwise the caller joins the FIFO queue for
+// up to cfg.QueueTimeout, returning ErrQueueTimeout if no slot frees up in
+// time.
+func (l *Limiter) Acquire(ctx context.Context, key string) (*Ticket, Status, error) {
+	l.mu.Lock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{}
+		l.buckets[key] = b
+	}
+
+	if b.inFlight < l.cfg.Limit {
+		b.inFlight++
+		status := Status{Remaining: l.cfg.Limit - b.inFlight, QueueDepth: len(b.waiters)}
+		l.mu.Unlock()
+		return &Ticket{l: l, key: key}, status, nil
+	}
+
+	if len(b.waiters) >= l.cfg.QueueLimit {
+		status := Status{Remaining: 0, QueueDepth: len(b.waiters)}
+		l.mu.Unlock()
+		return nil, status, ErrRejected
+	}
+
+	wait := make(chan struct{}, 1)
+	b.waiters = append(b.waiters, wait)
+	status := Status{Remaining: 0, QueueDepth: len(b.waiters)}
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-wait:
+		// Release() already accounted for this slot being taken over.
+		return &Ticket{l: l, key: key}, status, nil
+	case <-timer.C:
+		l.removeWaiter(key, wait)
+		return nil, status, ErrQueueTimeout
+	case <-ctx.Done():
+		l.removeWaiter(key, wait)
+		return nil, status, ctx.Err()
+	}
+}
+
+// removeWaiter drops wait from key's queue if it is still sitting there
+// unserved. If Release concurrently admitted it (sent on the channel) just
+// as the timeout/cancellation fired, the buffered send still succeeds; in
+// that case the reclaimed slot is handed to the next queued waiter via
+// freeSlotLocked (the same promotion Release itself would have done),
+// rather than sitting idle until some other caller happens to look at the
+// bucket again.
+func (l *Limiter) removeWaiter(key string, wait chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		return
+	}
+	for i, w := range b.waiters {
+		if w == wait {
+			b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+			return
+		}
+	}
+	// Not found in the queue: Release already promoted it. Drain the
+	// buffered admission signal and re-release the slot it was given.
+	select {
+	case <-wait:
+		l.freeSlotLocked(key, b)
+	default:
+	}
+}
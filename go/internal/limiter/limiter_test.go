@@ -0,0 +1,133 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireQueuedThenAdmitted(t *testing.T) {
+	l := New(Config{Limit: 1, QueueLimit: 1, QueueTimeout: time.Second})
+	ctx := context.Background()
+
+	first, _, err := l.Acquire(ctx, "k")
+	if err != nil {
+		t.Fatalf("first Acquire: unexpected error: %v", err)
+	}
+
+	type result struct {
+		ticket *Ticket
+		status Status
+		err    error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		ticket, status, err := l.Acquire(ctx, "k")
+		resCh <- result{ticket, status, err}
+	}()
+
+	// Give the second caller a chance to actually enter the queue before
+	// freeing the slot, so this exercises the queued path rather than a
+	// race where it happens to be admitted immediately.
+	time.Sleep(20 * time.Millisecond)
+	first.Release()
+
+	select {
+	case res := <-resCh:
+		if res.err != nil {
+			t.Fatalf("queued Acquire: unexpected error: %v", res.err)
+		}
+		if res.ticket == nil {
+			t.Fatal("queued Acquire: expected a ticket")
+		}
+		res.ticket.Release()
+	case <-time.After(time.Second):
+		t.Fatal("queued Acquire: timed out waiting for admission")
+	}
+}
+
+func TestAcquireQueuedThenTimedOut(t *testing.T) {
+	l := New(Config{Limit: 1, QueueLimit: 1, QueueTimeout: 30 * time.Millisecond})
+	ctx := context.Background()
+
+	held, _, err := l.Acquire(ctx, "k")
+	if err != nil {
+		t.Fatalf("first Acquire: unexpected error: %v", err)
+	}
+	defer held.Release()
+
+	_, _, err = l.Acquire(ctx, "k")
+	if !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("expected ErrQueueTimeout, got %v", err)
+	}
+}
+
+func TestAcquireHardRejected(t *testing.T) {
+	l := New(Config{Limit: 1, QueueLimit: 1, QueueTimeout: time.Second})
+	ctx := context.Background()
+
+	held, _, err := l.Acquire(ctx, "k")
+	if err != nil {
+		t.Fatalf("first Acquire: unexpected error: %v", err)
+	}
+
+	// Second caller fills the one available queue slot; it must not time
+	// out mid-test, so give it the full queue timeout and release before
+	// that.
+	queuedDone := make(chan struct{})
+	go func() {
+		defer close(queuedDone)
+		l.Acquire(ctx, "k")
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Third caller finds the key at its concurrency limit with a full
+	// queue, and must be rejected immediately rather than waiting.
+	start := time.Now()
+	_, _, err = l.Acquire(ctx, "k")
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, ErrRejected) {
+		t.Fatalf("expected ErrRejected, got %v", err)
+	}
+	if elapsed > 100*time.Millisecond {
+		t.Fatalf("hard rejection should be immediate, took %v", elapsed)
+	}
+
+	held.Release()
+	<-queuedDone
+}
+
+// TestRemoveWaiterPromotesNextOnRaceWithRelease is a white-box regression
+// test for the race between Release promoting a waiter and that same
+// waiter's Acquire call timing out (or its ctx being canceled) at the same
+// instant: the reclaimed slot must be handed to the next queued waiter
+// instead of merely being freed and left idle.
+func TestRemoveWaiterPromotesNextOnRaceWithRelease(t *testing.T) {
+	l := New(Config{Limit: 1, QueueTimeout: time.Hour})
+	key := "k"
+
+	l.mu.Lock()
+	b := &bucket{inFlight: 1}
+	w1 := make(chan struct{}, 1)
+	w2 := make(chan struct{}, 1)
+	b.waiters = []chan struct{}{w1, w2}
+	l.buckets[key] = b
+	l.mu.Unlock()
+
+	// Simulate Release firing for w1 concurrently with w1's Acquire call
+	// timing out: Release pops w1 off the queue and sends on it...
+	ticket := &Ticket{l: l, key: key}
+	ticket.Release()
+
+	// ...and then removeWaiter runs, as it would from Acquire's timeout
+	// branch, for the very channel Release just admitted.
+	l.removeWaiter(key, w1)
+
+	select {
+	case <-w2:
+	default:
+		t.Fatal("expected w2 to be promoted after the reclaimed slot was handed back")
+	}
+}
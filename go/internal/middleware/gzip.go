@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"strings"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+)
+
+// GzipMinBytes is the minimum uncompressed response size Gzip will bother
+// compressing; below this, compression overhead outweighs the saving.
+const GzipMinBytes = 1024
+
+// Gzip compresses the response when the client sent
+// `Accept-Encoding: gzip` and the origin response is both uncompressed and
+// at least GzipMinBytes long, the same bar NYTimes/gziphandler uses. It
+// sets `Vary: Accept-Encoding` on every response (compressed or not, so
+// caches don't serve a gzipped response to a client that can't decode it)
+// and strips Content-Length once compression kicks in, since the
+// compressed size isn't known until the body has been written.
+func Gzip() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			if !acceptsGzip(r) {
+				next(ctx, w, r)
+				return
+			}
+
+			gw := &gzipResponseWriter{ResponseWriter: w, minBytes: GzipMinBytes}
+			next(ctx, gw, r)
+			gw.Close()
+		}
+	}
+}
+
+func acceptsGzip(r *fsthttp.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.EqualFold(strings.TrimSpace(enc), "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the first minBytes of the response before
+// deciding whether compression is worthwhile. If the response turns out
+// shorter than minBytes, or the origin already encoded it, the buffered
+// bytes are flushed through unmodified; otherwise a gzip.Writer takes over
+// for the remainder of the body.
+type gzipResponseWriter struct {
+	fsthttp.ResponseWriter
+	minBytes int
+
+	statusCode  int
+	wroteHeader bool
+	buf         bytes.Buffer
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	// Deferred: whether we end up compressing isn't known until the first
+	// Write, and Content-Encoding/Content-Length must be decided before
+	// any header reaches the client.
+	g.statusCode = status
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	if g.passthrough {
+		g.flushHeader()
+		return g.ResponseWriter.Write(p)
+	}
+
+	g.buf.Write(p)
+	if g.buf.Len() < g.minBytes {
+		return len(p), nil
+	}
+
+	if g.ResponseWriter.Header().Get("Content-Encoding") != "" {
+		// Already encoded upstream; compressing again would just waste
+		// cycles and break the existing encoding.
+		g.passthrough = true
+		g.flushHeader()
+		if _, err := g.ResponseWriter.Write(g.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		g.buf.Reset()
+		return len(p), nil
+	}
+
+	g.ResponseWriter.Header().Del("Content-Length")
+	g.ResponseWriter.Header().Set("Content-Encoding", "gzip")
+	g.flushHeader()
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	if _, err := g.gz.Write(g.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	g.buf.Reset()
+	return len(p), nil
+}
+
+func (g *gzipResponseWriter) flushHeader() {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	if g.statusCode == 0 {
+		g.statusCode = fsthttp.StatusOK
+	}
+	g.ResponseWriter.WriteHeader(g.statusCode)
+}
+
+// Close flushes whatever is left: a live gzip.Writer, or a buffered
+// response that never reached minBytes and so was never compressed. It
+// must be called once the wrapped handler has finished writing.
+func (g *gzipResponseWriter) Close() {
+	if g.gz != nil {
+		g.gz.Close()
+		return
+	}
+	g.flushHeader()
+	if g.buf.Len() > 0 {
+		g.ResponseWriter.Write(g.buf.Bytes())
+		g.buf.Reset()
+	}
+}
@@ -0,0 +1,29 @@
+// Package middleware turns the proxy from a bare pass-through into a small,
+// ordered pipeline of response transforms (gzip, CORS, header rewriting),
+// modeled on the same func(next Handler) Handler shape net/http middleware
+// chains use (e.g. gorilla/handlers, justinas/alice), so new transforms can
+// be added later without touching existing ones.
+package middleware
+
+import (
+	"context"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+)
+
+// Handler is the proxy's request-handling signature, matching the one
+// fsthttp.ServeFunc expects.
+type Handler func(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request)
+
+// Middleware wraps a Handler to produce another.
+type Middleware func(next Handler) Handler
+
+// Chain composes ms around h, in order: ms[0] is outermost, so it observes
+// the request first and the response (via whatever ResponseWriter it hands
+// down) last.
+func Chain(h Handler, ms ...Middleware) Handler {
+	for i := len(ms) - 1; i >= 0; i-- {
+		h = ms[i](h)
+	}
+	return h
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+)
+
+// RewriteOptions configures the header-rewrite middleware.
+type RewriteOptions struct {
+	// StripSetCookie drops any Set-Cookie header the origin returned,
+	// since a dynamic backend's session cookie is almost never meant for
+	// the proxy's own domain.
+	StripSetCookie bool
+	// RewriteLocation rewrites a redirect Location that points back at
+	// OriginHost to PublicHost instead, so a client following the
+	// redirect doesn't leak the internal origin hostname and keeps
+	// talking to the proxy.
+	RewriteLocation bool
+	OriginHost      string
+	PublicHost      string
+}
+
+// RewriteHeaders applies opts to the response headers right before they're
+// sent, via a ResponseWriter wrapper rather than post-processing, so it
+// works the same whether the handler calls WriteHeader explicitly or lets
+// the first Write imply a 200.
+func RewriteHeaders(opts RewriteOptions) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request) {
+			next(ctx, &headerRewriteWriter{ResponseWriter: w, opts: opts}, r)
+		}
+	}
+}
+
+type headerRewriteWriter struct {
+	fsthttp.ResponseWriter
+	opts      RewriteOptions
+	rewritten bool
+}
+
+func (h *headerRewriteWriter) WriteHeader(status int) {
+	h.rewrite()
+	h.ResponseWriter.WriteHeader(status)
+}
+
+func (h *headerRewriteWriter) Write(p []byte) (int, error) {
+	h.rewrite()
+	return h.ResponseWriter.Write(p)
+}
+
+func (h *headerRewriteWriter) rewrite() {
+	if h.rewritten {
+		return
+	}
+	h.rewritten = true
+
+	if h.opts.StripSetCookie {
+		h.ResponseWriter.Header().Del("Set-Cookie")
+	}
+
+	if h.opts.RewriteLocation && h.opts.OriginHost != "" && h.opts.PublicHost != "" {
+		loc := h.ResponseWriter.Header().Get("Location")
+		if loc == "" {
+			return
+		}
+		u, err := url.Parse(loc)
+		if err != nil || !strings.EqualFold(u.Hostname(), h.opts.OriginHost) {
+			return
+		}
+		u.Host = h.opts.PublicHost
+		h.ResponseWriter.Header().Set("Location", u.String())
+	}
+}
@@ -0,0 +1,287 @@
+// Package policy implements the allow/deny host policy consulted by the
+// proxy after isPrivateHost has ruled out RFC1918/loopback/link-local
+// targets. Where isPrivateHost is a fixed SSRF guard, policy is the
+// operator-configurable layer on top of it: which public hosts a given
+// deployment (or a given API key) is actually allowed to reach.
+//
+// Rules may be exact hostnames ("api.example.com"), wildcards
+// ("*.example.com", matching subdomains at any depth but not the bare
+// domain), or CIDR blocks ("203.0.113.0/24") that are matched
+// against the hostname's resolved IPs rather than the hostname text.
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+)
+
+// HostList is a parsed set of host-matching rules: hostnames and wildcard
+// patterns are matched against the hostname text, CIDRs are matched against
+// the hostname's resolved addresses.
+type HostList struct {
+	exact     map[string]bool
+	wildcards []string // each stored without the leading "*", e.g. ".example.com"
+	cidrs     []*net.IPNet
+}
+
+// parseHostList splits raw rule strings into the three matching strategies.
+// Malformed CIDRs are dropped rather than failing the whole list, since a
+// single bad entry in an operator-edited config store shouldn't take down
+// every other rule.
+func parseHostList(rules []string) HostList {
+	hl := HostList{exact: make(map[string]bool)}
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if rule == "" {
+			continue
+		}
+		switch {
+		case strings.Contains(rule, "/"):
+			if _, ipnet, err := net.ParseCIDR(rule); err == nil {
+				hl.cidrs = append(hl.cidrs, ipnet)
+			}
+		case strings.HasPrefix(rule, "*."):
+			hl.wildcards = append(hl.wildcards, rule[1:])
+		default:
+			hl.exact[rule] = true
+		}
+	}
+	return hl
+}
+
+// matchesHost reports whether hostname (already lowercased) matches an
+// exact or wildcard rule in hl. It does not consult CIDRs, since those
+// require resolved IPs; see matchesIPs.
+func (hl HostList) matchesHost(hostname string) bool {
+	if hl.exact[hostname] {
+		return true
+	}
+	for _, suffix := range hl.wildcards {
+		if strings.HasSuffix(hostname, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCIDRs reports whether hl has any CIDR rules, so callers can skip DNS
+// resolution entirely when it would be wasted work.
+func (hl HostList) hasCIDRs() bool {
+	return len(hl.cidrs) > 0
+}
+
+// matchesIPs reports whether any of ips falls inside one of hl's CIDRs.
+func (hl HostList) matchesIPs(ips []net.IP) bool {
+	for _, cidr := range hl.cidrs {
+		for _, ip := range ips {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rawDocument is the JSON shape read from either a Fastly config store entry
+// or the embedded local-dev fallback file.
+type rawDocument struct {
+	Allow  []string               `json:"allow"`
+	Deny   []string               `json:"deny"`
+	Scopes map[string][]string    `json:"scopes"` // API key -> allow-list, replaces the global allow list for that key
+	Hosts  map[string]*HostConfig `json:"hosts"`  // hostname -> middleware pipeline config for that host
+}
+
+// HostConfig is the per-allowlisted-host middleware configuration consulted
+// by hostMiddlewares in main.go when building a request's transform
+// pipeline from internal/middleware. A
+// host absent from the document gets the zero value: no gzip, no CORS, no
+// header rewriting, matching the proxy's historical bare pass-through
+// behavior unless an operator opts a host in.
+type HostConfig struct {
+	Gzip            bool     `json:"gzip"`
+	CORSOrigins     []string `json:"cors_origins"`
+	CORSMethods     []string `json:"cors_methods"`
+	CORSHeaders     []string `json:"cors_headers"`
+	StripSetCookie  bool     `json:"strip_set_cookie"`
+	RewriteLocation bool     `json:"rewrite_location"`
+}
+
+// scope is the parsed per-API-key allow list.
+type scope struct {
+	allow HostList
+}
+
+// Policy is the parsed, queryable form of a rawDocument. The zero value
+// denies nothing and allows everything (no restrictions configured).
+type Policy struct {
+	allow  HostList
+	deny   HostList
+	scopes map[string]scope
+	hosts  map[string]HostConfig
+}
+
+// HostConfig returns the middleware pipeline configuration for hostname, or
+// the zero value (every transform disabled) if the document has none.
+func (p Policy) HostConfig(hostname string) HostConfig {
+	if cfg, ok := p.hosts[strings.ToLower(hostname)]; ok {
+		return cfg
+	}
+	return HostConfig{}
+}
+
+// Resolver resolves a hostname to its addresses. It is satisfied by
+// (*net.Resolver).LookupIPAddr with the IP extracted from each IPAddr; tests
+// substitute a stub so CIDR matching doesn't depend on real DNS.
+type Resolver func(ctx context.Context, hostname string) ([]net.IP, error)
+
+// DefaultResolver resolves via the standard library resolver.
+func DefaultResolver(ctx context.Context, hostname string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+func parsePolicy(doc rawDocument) Policy {
+	p := Policy{
+		allow:  parseHostList(doc.Allow),
+		deny:   parseHostList(doc.Deny),
+		scopes: make(map[string]scope, len(doc.Scopes)),
+		hosts:  make(map[string]HostConfig, len(doc.Hosts)),
+	}
+	for key, allow := range doc.Scopes {
+		p.scopes[key] = scope{allow: parseHostList(allow)}
+	}
+	for host, cfg := range doc.Hosts {
+		if cfg != nil {
+			p.hosts[strings.ToLower(host)] = *cfg
+		}
+	}
+	return p
+}
+
+// Decision is the outcome of evaluating a hostname against a Policy.
+type Decision struct {
+	Allowed bool
+	// Reason is a short machine-stable string ("denylisted",
+	// "not-in-allowlist", "allowed") suitable for the structured 403 body.
+	Reason string
+}
+
+// Evaluate decides whether hostname may be fetched on behalf of apiKey.
+//
+//   - If apiKey has a scope configured, that scope's allow list replaces the
+//     global allow list for the decision; the global deny list still
+//     applies to every key.
+//   - The deny list is checked first: a hostname match, or a resolved IP
+//     falling in a denied CIDR, is always rejected.
+//   - If the applicable allow list is empty, any host not denied is
+//     allowed (no allowlist configured means "don't restrict further").
+//     If it is non-empty, hostname must match it (by name or resolved IP)
+//     to be allowed.
+func (p Policy) Evaluate(ctx context.Context, hostname, apiKey string, resolve Resolver) Decision {
+	if resolve == nil {
+		resolve = DefaultResolver
+	}
+	hostname = strings.ToLower(hostname)
+
+	if p.deny.matchesHost(hostname) {
+		return Decision{Allowed: false, Reason: "denylisted"}
+	}
+	if p.deny.hasCIDRs() {
+		// The denylist must fail closed: if we can't resolve hostname at
+		// all, we have no way to know it *doesn't* land in a denied CIDR,
+		// so treat resolution failure the same as a match rather than
+		// silently falling through to the allow check.
+		ips, err := resolve(ctx, hostname)
+		if err != nil {
+			return Decision{Allowed: false, Reason: "denylisted"}
+		}
+		if p.deny.matchesIPs(ips) {
+			return Decision{Allowed: false, Reason: "denylisted"}
+		}
+	}
+
+	allow := p.allow
+	if s, ok := p.scopes[apiKey]; ok {
+		allow = s.allow
+	}
+
+	if len(allow.exact) == 0 && len(allow.wildcards) == 0 && !allow.hasCIDRs() {
+		return Decision{Allowed: true, Reason: "allowed"}
+	}
+	if allow.matchesHost(hostname) {
+		return Decision{Allowed: true, Reason: "allowed"}
+	}
+	if allow.hasCIDRs() {
+		if ips, err := resolve(ctx, hostname); err == nil && allow.matchesIPs(ips) {
+			return Decision{Allowed: true, Reason: "allowed"}
+		}
+	}
+	return Decision{Allowed: false, Reason: "not-in-allowlist"}
+}
+
+// Source loads the raw policy document bytes from wherever it lives (a
+// Fastly config store entry, an embedded local-dev file, ...). Load is
+// called once at startup and again on every hot-reload tick.
+type Source interface {
+	Load() ([]byte, error)
+}
+
+// Manager holds the live Policy and re-reads its Source no more often than
+// every Interval, so a hot request path never pays for more than a
+// timestamp comparison. Compute@Edge instances have no background timers
+// between requests, so reloading is lazy: the next request after Interval
+// has elapsed triggers the re-read.
+type Manager struct {
+	source   Source
+	interval time.Duration
+
+	now     func() time.Time
+	current Policy
+	loadErr error
+	lastAt  time.Time
+}
+
+// NewManager constructs a Manager that reloads from source at most once per
+// interval. The first Current call always loads.
+func NewManager(source Source, interval time.Duration) *Manager {
+	return &Manager{source: source, interval: interval, now: time.Now}
+}
+
+// Current returns the live Policy, reloading from the Source first if
+// Interval has elapsed since the last (successful or failed) load attempt.
+// A reload failure keeps serving the last good Policy. If no load has ever
+// succeeded, the Policy returned alongside the error is the zero value,
+// which allows every host.
+func (m *Manager) Current() (Policy, error) {
+	now := m.now()
+	if !m.lastAt.IsZero() && now.Sub(m.lastAt) < m.interval {
+		return m.current, m.loadErr
+	}
+	m.lastAt = now
+
+	raw, err := m.source.Load()
+	if err != nil {
+		m.loadErr = err
+		return m.current, err
+	}
+
+	var doc rawDocument
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		m.loadErr = err
+		return m.current, err
+	}
+
+	m.current = parsePolicy(doc)
+	m.loadErr = nil
+	return m.current, nil
+}
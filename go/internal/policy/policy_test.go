@@ -0,0 +1,155 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMatchesHostWildcardVsMultiLevelSubdomain(t *testing.T) {
+	hl := parseHostList([]string{"*.example.com"})
+
+	cases := map[string]bool{
+		"foo.example.com": true,
+		"a.b.example.com": true, // wildcards match any depth of subdomain, not just one level
+		"example.com":     false,
+		"notexample.com":  false,
+		"fooexample.com":  false,
+	}
+	for host, want := range cases {
+		if got := hl.matchesHost(host); got != want {
+			t.Errorf("matchesHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestEvaluateScopeOverridesAllow(t *testing.T) {
+	p := parsePolicy(rawDocument{
+		Allow: []string{"global.example.com"},
+		Scopes: map[string][]string{
+			"scoped-key": {"scoped.example.com"},
+		},
+	})
+
+	// The scoped key's own list replaces the global allow list entirely:
+	// the globally allowed host is not reachable under it...
+	d := p.Evaluate(context.Background(), "global.example.com", "scoped-key", nil)
+	if d.Allowed {
+		t.Fatalf("expected global.example.com denied for scoped-key, got allowed (%s)", d.Reason)
+	}
+	// ...while its own scoped host is.
+	d = p.Evaluate(context.Background(), "scoped.example.com", "scoped-key", nil)
+	if !d.Allowed {
+		t.Fatalf("expected scoped.example.com allowed for scoped-key, got denied (%s)", d.Reason)
+	}
+	// An unscoped key still gets the global list.
+	d = p.Evaluate(context.Background(), "global.example.com", "other-key", nil)
+	if !d.Allowed {
+		t.Fatalf("expected global.example.com allowed for other-key, got denied (%s)", d.Reason)
+	}
+}
+
+func TestEvaluateDenyBeatsAllow(t *testing.T) {
+	p := parsePolicy(rawDocument{
+		Allow: []string{"shared.example.com"},
+		Deny:  []string{"shared.example.com"},
+	})
+
+	d := p.Evaluate(context.Background(), "shared.example.com", "any-key", nil)
+	if d.Allowed {
+		t.Fatalf("expected denylisted host to be denied even though it's also allowlisted, got allowed")
+	}
+	if d.Reason != "denylisted" {
+		t.Fatalf("Reason = %q, want %q", d.Reason, "denylisted")
+	}
+}
+
+func TestEvaluateEmptyAllowAllowsAll(t *testing.T) {
+	p := parsePolicy(rawDocument{Deny: []string{"blocked.example.com"}})
+
+	d := p.Evaluate(context.Background(), "anything.example.com", "any-key", nil)
+	if !d.Allowed {
+		t.Fatalf("expected no allowlist to allow any non-denied host, got denied (%s)", d.Reason)
+	}
+
+	d = p.Evaluate(context.Background(), "blocked.example.com", "any-key", nil)
+	if d.Allowed {
+		t.Fatalf("expected denylisted host to still be denied when no allowlist is configured")
+	}
+}
+
+func TestEvaluateDenyCIDRFailsClosedOnResolveError(t *testing.T) {
+	p := parsePolicy(rawDocument{Deny: []string{"203.0.113.0/24"}})
+
+	resolveErr := errors.New("dns unavailable")
+	failingResolve := func(ctx context.Context, hostname string) ([]net.IP, error) {
+		return nil, resolveErr
+	}
+
+	d := p.Evaluate(context.Background(), "maybe-denied.example.com", "any-key", failingResolve)
+	if d.Allowed {
+		t.Fatalf("expected resolve failure against a non-empty deny-CIDR set to fail closed (deny), got allowed")
+	}
+	if d.Reason != "denylisted" {
+		t.Fatalf("Reason = %q, want %q", d.Reason, "denylisted")
+	}
+}
+
+func TestEvaluateDenyCIDRMatchesResolvedIP(t *testing.T) {
+	p := parsePolicy(rawDocument{Deny: []string{"203.0.113.0/24"}})
+
+	resolve := func(ctx context.Context, hostname string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("203.0.113.5")}, nil
+	}
+
+	d := p.Evaluate(context.Background(), "denied-by-ip.example.com", "any-key", resolve)
+	if d.Allowed {
+		t.Fatalf("expected host resolving into a denied CIDR to be denied")
+	}
+}
+
+// countingSource records how many times Load is called, so
+// TestManagerReloadInterval can assert the gate actually skips re-reads
+// within the interval and re-reads after it.
+type countingSource struct {
+	loads int
+}
+
+func (s *countingSource) Load() ([]byte, error) {
+	s.loads++
+	return []byte(`{"allow":[]}`), nil
+}
+
+func TestManagerReloadInterval(t *testing.T) {
+	src := &countingSource{}
+	now := time.Now()
+	m := NewManager(src, time.Minute)
+	m.now = func() time.Time { return now }
+
+	if _, err := m.Current(); err != nil {
+		t.Fatalf("first Current: unexpected error: %v", err)
+	}
+	if src.loads != 1 {
+		t.Fatalf("loads after first Current = %d, want 1", src.loads)
+	}
+
+	// Still within the interval: no re-read.
+	now = now.Add(30 * time.Second)
+	if _, err := m.Current(); err != nil {
+		t.Fatalf("second Current: unexpected error: %v", err)
+	}
+	if src.loads != 1 {
+		t.Fatalf("loads after second Current (within interval) = %d, want 1", src.loads)
+	}
+
+	// Interval elapsed: re-read.
+	now = now.Add(time.Minute)
+	if _, err := m.Current(); err != nil {
+		t.Fatalf("third Current: unexpected error: %v", err)
+	}
+	if src.loads != 2 {
+		t.Fatalf("loads after third Current (interval elapsed) = %d, want 2", src.loads)
+	}
+}
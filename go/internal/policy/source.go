@@ -0,0 +1,58 @@
+package policy
+
+import (
+	_ "embed"
+	"fmt"
+
+	"github.com/fastly/compute-sdk-go/configstore"
+)
+
+// configStoreKey is the single entry within the config store that holds the
+// full policy document as a JSON string. Splitting allow/deny/scopes into
+// separate entries would save a few bytes per read but forces readers and
+// writers to keep three entries in sync, so one JSON blob is read instead.
+const configStoreKey = "policy"
+
+// ConfigStoreSource loads the policy document from a named Fastly config
+// store, matching how this service expects operators to manage the
+// allow/deny lists in production.
+type ConfigStoreSource struct {
+	storeName string
+}
+
+// NewConfigStoreSource returns a Source backed by the named config store.
+func NewConfigStoreSource(storeName string) *ConfigStoreSource {
+	return &ConfigStoreSource{storeName: storeName}
+}
+
+// Load implements Source.
+func (s *ConfigStoreSource) Load() ([]byte, error) {
+	store, err := configstore.Open(s.storeName)
+	if err != nil {
+		return nil, fmt.Errorf("policy: open config store %q: %w", s.storeName, err)
+	}
+	doc, err := store.Get(configStoreKey)
+	if err != nil {
+		return nil, fmt.Errorf("policy: read %q from config store %q: %w", configStoreKey, s.storeName, err)
+	}
+	return []byte(doc), nil
+}
+
+//go:embed policy.local.json
+var embeddedLocalPolicy []byte
+
+// EmbeddedSource loads the policy document bundled into the compute package
+// at build time, for `viceroy` local dev where no config store is
+// attached. Edit policy.local.json and rebuild to change it.
+type EmbeddedSource struct{}
+
+// NewEmbeddedSource returns a Source backed by the embedded local-dev
+// policy document.
+func NewEmbeddedSource() EmbeddedSource {
+	return EmbeddedSource{}
+}
+
+// Load implements Source.
+func (EmbeddedSource) Load() ([]byte, error) {
+	return embeddedLocalPolicy, nil
+}
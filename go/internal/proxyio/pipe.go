@@ -0,0 +1,151 @@
+// Package proxyio copies an origin response body to the client with the
+// safety net a bare io.Copy lacks: a max-size cap, an overall deadline, and
+// a bounded drain of the origin body on client cancellation so a reused
+// keepalive connection isn't left with unread bytes on it (the same
+// problem go-openapi/runtime's drainingReadCloser solves).
+package proxyio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrTooLarge is returned by Pipe when the origin body exceeds MaxBytes.
+// By then dst has received exactly the first MaxBytes bytes; Pipe writes no
+// truncation trailer or other marker. It is reported so callers can log or
+// count truncations.
+var ErrTooLarge = errors.New("proxyio: response exceeded max size, truncated")
+
+// drainBytes is how much of an abandoned origin body Pipe reads before
+// giving up and closing the connection anyway, bounding the cost of
+// draining a huge or hanging body.
+const drainBytes = 64 * 1024
+
+// drainDeadline bounds how long the best-effort drain on cancellation is
+// allowed to take.
+const drainDeadline = 500 * time.Millisecond
+
+// flushInterval is how often Pipe flushes the destination Writer while
+// copying, so a client streaming a large response sees steady progress
+// instead of one write at the end.
+const flushInterval = 256 * 1024
+
+// Flusher is implemented by response writers that can push buffered bytes
+// to the client immediately, such as fsthttp.ResponseWriter.
+type Flusher interface {
+	Flush() error
+}
+
+// Options configures a single Pipe call.
+type Options struct {
+	// MaxBytes caps how much of src is copied to dst. Zero means no cap.
+	MaxBytes int64
+	// Deadline, if non-zero, is the wall-clock time by which the copy must
+	// finish; the context passed to Pipe is usually sufficient, but
+	// Deadline lets callers impose a tighter bound than ctx's without
+	// constructing a derived context at every call site.
+	Deadline time.Time
+}
+
+// Pipe copies src to dst under ctx, honoring opts. It returns the number of
+// bytes copied and an error, which is:
+//
+//   - nil on a clean, complete copy
+//   - ErrTooLarge if MaxBytes was reached (dst has received the first
+//     MaxBytes bytes and nothing else; no truncation trailer is written, so
+//     callers should treat this as "close the connection after a partial
+//     body")
+//   - ctx.Err() if ctx was canceled or its deadline/opts.Deadline passed;
+//     Pipe makes a bounded best-effort attempt to drain src before
+//     returning so the underlying connection can be reused
+//
+// If dst implements Flusher, Pipe flushes it periodically so progress is
+// visible to the client before the copy finishes.
+func Pipe(ctx context.Context, dst io.Writer, src io.Reader, opts Options) (int64, error) {
+	if !opts.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, opts.Deadline)
+		defer cancel()
+	}
+
+	flusher, _ := dst.(Flusher)
+
+	buf := make([]byte, 32*1024)
+	var written int64
+	var sinceFlush int64
+
+	for {
+		select {
+		case <-ctx.Done():
+			drain(src)
+			return written, ctx.Err()
+		default:
+		}
+
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if opts.MaxBytes > 0 && written+int64(n) > opts.MaxBytes {
+				allowed := opts.MaxBytes - written
+				if allowed > 0 {
+					if _, werr := dst.Write(buf[:allowed]); werr != nil {
+						return written, werr
+					}
+					written += allowed
+				}
+				drain(src)
+				return written, ErrTooLarge
+			}
+
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+			sinceFlush += int64(n)
+
+			if flusher != nil && sinceFlush >= flushInterval {
+				if ferr := flusher.Flush(); ferr != nil {
+					return written, ferr
+				}
+				sinceFlush = 0
+			}
+		}
+
+		if readErr != nil {
+			if errors.Is(readErr, io.EOF) {
+				if flusher != nil {
+					_ = flusher.Flush()
+				}
+				return written, nil
+			}
+			return written, readErr
+		}
+	}
+}
+
+// drain performs a bounded, best-effort read of an abandoned body so a
+// keepalive connection isn't poisoned by unread bytes left on the wire. It
+// never returns an error: this is cleanup, not a step the caller can react
+// to, and a body that refuses to drain within drainDeadline is simply
+// abandoned (the transport will close the connection instead of reusing
+// it).
+func drain(src io.Reader) {
+	type deadliner interface {
+		SetReadDeadline(time.Time) error
+	}
+	if d, ok := src.(deadliner); ok {
+		_ = d.SetReadDeadline(time.Now().Add(drainDeadline))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.CopyN(io.Discard, src, drainBytes)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(drainDeadline):
+	}
+}
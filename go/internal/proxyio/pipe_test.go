@@ -0,0 +1,89 @@
+package proxyio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPipeTruncatesAtMaxBytes(t *testing.T) {
+	src := strings.NewReader(strings.Repeat("a", 10_000))
+	var dst bytes.Buffer
+
+	n, err := Pipe(context.Background(), &dst, src, Options{MaxBytes: 100})
+
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+	if n != 100 {
+		t.Fatalf("written = %d, want 100", n)
+	}
+	if dst.Len() != 100 {
+		t.Fatalf("dst.Len() = %d, want 100", dst.Len())
+	}
+}
+
+// blockingReader simulates a slow/hung origin. Its first Read sleeps just
+// long enough that the caller's deadline/cancellation has already fired by
+// the time it returns a few bytes; every Read after that blocks far longer
+// than any deadline used in these tests, standing in for an origin that has
+// stopped sending without closing the connection. Pipe's forwarding loop
+// only checks ctx between Read calls, so the first Read's delay is what
+// guarantees the ctx.Done() branch (and not a second blocking Read on the
+// forwarding path) is what these tests actually exercise.
+type blockingReader struct {
+	reads int
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	r.reads++
+	if r.reads == 1 {
+		time.Sleep(50 * time.Millisecond)
+		n := copy(p, []byte("hello"))
+		return n, nil
+	}
+	time.Sleep(3 * time.Second)
+	return 0, nil
+}
+
+func TestPipeDeadlineExceeded(t *testing.T) {
+	src := &blockingReader{}
+	var dst bytes.Buffer
+
+	start := time.Now()
+	_, err := Pipe(context.Background(), &dst, src, Options{
+		Deadline: time.Now().Add(20 * time.Millisecond),
+	})
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	// The bounded drain (drainDeadline) must not let this test wait out
+	// the reader's full 3s block.
+	if elapsed > 2*time.Second {
+		t.Fatalf("Pipe took too long to return after its deadline: %v", elapsed)
+	}
+}
+
+func TestPipeDrainIsBoundedOnCancel(t *testing.T) {
+	src := &blockingReader{}
+	var dst bytes.Buffer
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // already canceled before Pipe even starts reading
+
+	start := time.Now()
+	_, err := Pipe(ctx, &dst, src, Options{})
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed > 2*time.Second {
+		t.Fatalf("drain on cancel should be bounded by drainDeadline, took %v", elapsed)
+	}
+}
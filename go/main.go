@@ -3,15 +3,23 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/url"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/fastly/compute-sdk-go/fsthttp"
+
+	"github.com/chrisbuckley/compute-dynbackends-dev/internal/devmode"
+	"github.com/chrisbuckley/compute-dynbackends-dev/internal/forwarded"
+	"github.com/chrisbuckley/compute-dynbackends-dev/internal/limiter"
+	"github.com/chrisbuckley/compute-dynbackends-dev/internal/middleware"
+	"github.com/chrisbuckley/compute-dynbackends-dev/internal/policy"
+	"github.com/chrisbuckley/compute-dynbackends-dev/internal/proxyio"
 )
 
 // isPrivateHost checks if hostname is a private/internal address (SSRF protection)
@@ -95,6 +103,85 @@ func isPrivateHost(hostname string) bool {
 	return false
 }
 
+// reqLimiter enforces a per-backend, per-API-key concurrency cap with a
+// bounded wait queue (see internal/limiter).
+//
+// TODO: as implemented this is per-instance, best-effort only, and does not
+// actually throttle anything in production. Compute@Edge runs each request
+// in a fresh, isolated Wasm instance (see main, below), so reqLimiter's
+// in-memory buckets never see more than one request for a given key before
+// the instance is torn down: the hard cap, the queue, and the 429/
+// Retry-After path are all unreachable, and X-RateLimit-Remaining /
+// X-Queue-Depth report full headroom for every request regardless of actual
+// load elsewhere in the fleet. A working fleet-wide cap needs state shared
+// across instances — a Fastly KV Store counter with a short TTL, or Fastly's
+// edge rate limiting product — not an in-process map. Leaving this in place
+// unchanged (rather than removing it) until that's built, since the
+// admission/queue/header plumbing around it is what a shared backend would
+// plug into.
+var reqLimiter = limiter.New(loadLimiterConfig())
+
+// loadLimiterConfig reads the limiter knobs from environment variables,
+// falling back to limiter.DefaultConfig for anything unset or invalid.
+// Compute@Edge services set these via `fastly compute publish --env` or the
+// service's edge dictionary; reading os.Getenv keeps local `viceroy` runs
+// and the deployed service in sync without a separate config path.
+func loadLimiterConfig() limiter.Config {
+	cfg := limiter.DefaultConfig
+	if v, err := strconv.Atoi(os.Getenv("API_LIMIT")); err == nil && v > 0 {
+		cfg.Limit = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("API_QUEUE_LIMIT")); err == nil && v >= 0 {
+		cfg.QueueLimit = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("API_QUEUE_TIMEOUT_SECONDS")); err == nil && v > 0 {
+		cfg.QueueTimeout = time.Duration(v) * time.Second
+	}
+	return cfg
+}
+
+// policyManager holds the live allow/deny host policy (see internal/policy),
+// re-reading its source at most once per reload interval.
+var policyManager = loadPolicyManager()
+
+// loadPolicyManager picks the policy Source based on POLICY_CONFIG_STORE: a
+// named Fastly config store in production, or the embedded local-dev
+// document when unset. POLICY_RELOAD_INTERVAL_SECONDS controls how often
+// the source is re-read; it defaults to a minute.
+func loadPolicyManager() *policy.Manager {
+	var source policy.Source
+	if name := os.Getenv("POLICY_CONFIG_STORE"); name != "" {
+		source = policy.NewConfigStoreSource(name)
+	} else {
+		source = policy.NewEmbeddedSource()
+	}
+
+	interval := 60 * time.Second
+	if v, err := strconv.Atoi(os.Getenv("POLICY_RELOAD_INTERVAL_SECONDS")); err == nil && v > 0 {
+		interval = time.Duration(v) * time.Second
+	}
+	return policy.NewManager(source, interval)
+}
+
+// maxResponseBytes caps the size of the origin response body copied to the
+// client; a zero value (the default) means no cap. Set via
+// MAX_RESPONSE_BYTES.
+var maxResponseBytes = func() int64 {
+	if v, err := strconv.ParseInt(os.Getenv("MAX_RESPONSE_BYTES"), 10, 64); err == nil && v > 0 {
+		return v
+	}
+	return 0
+}()
+
+// responseDeadline bounds how long streaming the origin response to the
+// client may take, set via RESPONSE_DEADLINE_SECONDS, defaulting to 60s.
+var responseDeadline = func() time.Duration {
+	if v, err := strconv.Atoi(os.Getenv("RESPONSE_DEADLINE_SECONDS")); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return 60 * time.Second
+}()
+
 func main() {
 	fsthttp.ServeFunc(handleRequest)
 }
@@ -132,8 +219,20 @@ func handleRequest(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Req
 		return
 	}
 
-	// Only allow https protocol (TLS backends only)
-	if targetURL.Scheme != "https" {
+	hostname := targetURL.Hostname()
+
+	// Dev mode: only enters effect with a valid, hostname-bound,
+	// unexpired token signed with the secret-store HMAC key (see
+	// internal/devmode). A missing or invalid token just means this is a
+	// normal request; we never report why a token didn't work.
+	devMode := false
+	if token := r.Header.Get("X-Dev-Mode-Token"); token != "" {
+		devMode = devmode.Verify(token, hostname) == nil
+	}
+
+	// Only allow https protocol (TLS backends only), unless dev mode has
+	// been granted for this exact hostname.
+	if targetURL.Scheme != "https" && !(devMode && targetURL.Scheme == "http") {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(fsthttp.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -143,36 +242,80 @@ func handleRequest(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Req
 		return
 	}
 
-	hostname := targetURL.Hostname()
 	port := targetURL.Port()
 	if port == "" {
-		port = "443"
+		if targetURL.Scheme == "http" {
+			port = "80"
+		} else {
+			port = "443"
+		}
 	}
 
-	// SSRF Protection: Block requests to private/internal hosts
-	if isPrivateHost(hostname) {
+	// SSRF Protection: Block requests to private/internal hosts, unless
+	// dev mode has been granted for this exact hostname.
+	if !devMode && isPrivateHost(hostname) {
 		writeJSONError(w, fsthttp.StatusForbidden, "Forbidden", "Requests to private or internal hosts are not allowed")
 		return
 	}
 
+	// Policy: once isPrivateHost has ruled out internal addresses, consult
+	// the operator-configured allow/deny lists for this API key. A reload
+	// error just means we keep evaluating against the last good policy (see
+	// policy.Manager), so it is intentionally not treated as fatal here; if
+	// no load has succeeded yet, that is the zero Policy, which allows every
+	// host.
+	pol, _ := policyManager.Current()
+	if decision := pol.Evaluate(ctx, hostname, apiKey, nil); !decision.Allowed {
+		writePolicyDeniedError(w, hostname, decision)
+		return
+	}
+
 	// Create a unique backend name based on host and port
 	// Backend names must be alphanumeric with underscores/hyphens
 	re := regexp.MustCompile(`[^a-zA-Z0-9]`)
 	sanitizedHostname := re.ReplaceAllString(hostname, "_")
 	backendName := fmt.Sprintf("dyn_%s_%s", sanitizedHostname, port)
 
-	// Create backend options with TLS
+	// Rate limiting: key on both the backend and the API key so one noisy
+	// tenant hammering a shared backend can't starve everyone else's quota
+	// on that same backend, and so one tenant's fan-out across many
+	// backends can't starve its own other requests either.
+	//
+	// See the TODO on reqLimiter above: with today's in-instance-only state
+	// this Acquire always succeeds immediately and these headers always
+	// report full headroom for this request; they do not reflect load
+	// anywhere else in the fleet.
+	limiterKey := backendName + "|" + apiKey
+	ticket, status, err := reqLimiter.Acquire(ctx, limiterKey)
+	if err != nil {
+		writeRateLimitedError(w, err, status)
+		return
+	}
+	defer ticket.Release()
+
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	w.Header().Set("X-Queue-Depth", strconv.Itoa(status.QueueDepth))
+
+	// Create backend options with TLS. Dev mode broadens these: it permits
+	// plaintext (UseSSL false for an http:// target) and, for https
+	// targets with self-signed certs, skips certificate verification and
+	// accepts older TLS versions.
 	opts := fsthttp.NewBackendOptions().
 		HostOverride(hostname).
-		UseSSL(true).
-		SSLMinVersion(fsthttp.TLSVersion1_2).
-		SSLMaxVersion(fsthttp.TLSVersion1_3).
+		UseSSL(targetURL.Scheme == "https").
 		SNIHostname(hostname).
 		CertHostname(hostname).
 		ConnectTimeout(10 * time.Second).
 		FirstByteTimeout(30 * time.Second).
 		BetweenBytesTimeout(30 * time.Second)
 
+	if devMode {
+		opts = opts.CheckCertificate(false).SSLMinVersion(fsthttp.TLSVersion1_0).SSLMaxVersion(fsthttp.TLSVersion1_3)
+		w.Header().Set("X-Proxy-Mode", "dev")
+	} else {
+		opts = opts.SSLMinVersion(fsthttp.TLSVersion1_2).SSLMaxVersion(fsthttp.TLSVersion1_3)
+	}
+
 	// Create the dynamic backend
 	backend, err := fsthttp.RegisterDynamicBackend(backendName, fmt.Sprintf("%s:%s", hostname, port), opts)
 	if err != nil {
@@ -180,61 +323,169 @@ func handleRequest(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Req
 		return
 	}
 
-	// Build the request to the origin
-	// Preserve the path and query string from the target URL
-	originPath := targetURL.Path
-	if targetURL.RawQuery != "" {
-		originPath = originPath + "?" + targetURL.RawQuery
-	}
-	if originPath == "" {
-		originPath = "/"
-	}
+	// fetchOrigin does the actual origin round-trip and response streaming.
+	// It is wrapped in the host's configured middleware.Chain below so that
+	// gzip/CORS/header-rewrite transforms see (and can alter) exactly what
+	// this proxy would otherwise have sent verbatim.
+	fetchOrigin := func(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request) {
+		// Preserve the path and query string from the target URL
+		originPath := targetURL.Path
+		if targetURL.RawQuery != "" {
+			originPath = originPath + "?" + targetURL.RawQuery
+		}
+		if originPath == "" {
+			originPath = "/"
+		}
 
-	// Create a new request to the origin
-	originReq, err := fsthttp.NewRequest(r.Method, originPath, r.Body)
-	if err != nil {
-		writeJSONErrorWithTarget(w, fsthttp.StatusBadGateway, "Failed to create origin request", err.Error(), targetURLParam)
-		return
-	}
+		// Create a new request to the origin
+		originReq, err := fsthttp.NewRequest(r.Method, originPath, r.Body)
+		if err != nil {
+			writeJSONErrorWithTarget(w, fsthttp.StatusBadGateway, "Failed to create origin request", err.Error(), targetURLParam)
+			return
+		}
 
-	// Copy headers from original request
-	for name, values := range r.Header {
-		// Skip headers that shouldn't be forwarded
-		nameLower := strings.ToLower(name)
-		if nameLower == "x-forwarded-for" ||
-			nameLower == "x-forwarded-host" ||
-			nameLower == "x-forwarded-proto" ||
-			nameLower == "host" {
-			continue
+		// Copy headers from original request. X-Forwarded-For is kept as-is
+		// here (forwarded.Rewrite below decides whether to chain onto it or
+		// discard it per the trust-boundary setting); the other
+		// forwarded-identity headers and Host are dropped so they can be
+		// rebuilt deliberately below instead of passed through untouched.
+		for name, values := range r.Header {
+			nameLower := strings.ToLower(name)
+			if nameLower == "x-forwarded-host" ||
+				nameLower == "x-forwarded-proto" ||
+				nameLower == "forwarded" ||
+				nameLower == "host" {
+				continue
+			}
+			for _, value := range values {
+				originReq.Header.Add(name, value)
+			}
+		}
+
+		// Set the host header to match the target
+		originReq.Header.Set("Host", hostname)
+
+		// Rewrite the forwarded-identity headers instead of dropping them, so
+		// the origin still sees client-IP and original-host context. Each
+		// header is individually toggleable via query parameter, defaulting to
+		// on, so operators can opt a backend out if it mishandles them.
+		forwarded.Rewrite(originReq.Header, forwarded.Options{
+			XForwardedFor:     queryBool(reqURL, "xff", true),
+			TrustInboundChain: queryBool(reqURL, "xff_trust", false),
+			XForwardedHost:    queryBool(reqURL, "xfh", true),
+			XForwardedProto:   queryBool(reqURL, "xfp", true),
+			Forwarded:         queryBool(reqURL, "fwd", true),
+			ClientIP:          clientIP(r),
+			Host:              incomingHost(r, reqURL),
+			Proto:             incomingScheme(reqURL),
+		})
+
+		// Set cache override to pass (don't cache)
+		originReq.CacheOptions.Pass = true
+
+		// Fetch from the dynamic backend
+		resp, err := originReq.Send(ctx, backend.Name())
+		if err != nil {
+			writeJSONErrorWithTarget(w, fsthttp.StatusBadGateway, "Failed to fetch from origin", err.Error(), targetURLParam)
+			return
 		}
-		for _, value := range values {
-			originReq.Header.Add(name, value)
+
+		// Copy response headers
+		for name, values := range resp.Header {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+		}
+
+		// Write status code and stream the body through proxyio.Pipe, which
+		// caps the size, enforces an overall deadline, and drains the origin
+		// body on client cancellation instead of leaving it half-read on a
+		// connection that might otherwise be reused.
+		w.WriteHeader(resp.StatusCode)
+		_, err = proxyio.Pipe(ctx, w, resp.Body, proxyio.Options{
+			MaxBytes: maxResponseBytes,
+			Deadline: time.Now().Add(responseDeadline),
+		})
+		if err != nil && !errors.Is(err, proxyio.ErrTooLarge) {
+			// Headers and a partial body are already on the wire; there is
+			// nothing more we can tell the client at this point beyond
+			// closing the connection, which returning does for us.
+			return
 		}
 	}
 
-	// Set the host header to match the target
-	originReq.Header.Set("Host", hostname)
+	publicHost := incomingHost(r, reqURL)
+	middleware.Chain(fetchOrigin, hostMiddlewares(pol.HostConfig(hostname), hostname, publicHost)...)(ctx, w, r)
+}
 
-	// Set cache override to pass (don't cache)
-	originReq.CacheOptions.Pass = true
+// hostMiddlewares builds the ordered transform pipeline for a host from its
+// policy.HostConfig: CORS first (outermost, so it can answer a preflight
+// without ever running the other transforms), then header rewriting, then
+// gzip (innermost, closest to the raw bytes). A host with every flag unset
+// gets an empty pipeline, i.e. today's bare pass-through behavior.
+func hostMiddlewares(cfg policy.HostConfig, originHost, publicHost string) []middleware.Middleware {
+	var ms []middleware.Middleware
+
+	if len(cfg.CORSOrigins) > 0 {
+		ms = append(ms, middleware.CORS(middleware.CORSOptions{
+			AllowedOrigins: cfg.CORSOrigins,
+			AllowedMethods: cfg.CORSMethods,
+			AllowedHeaders: cfg.CORSHeaders,
+		}))
+	}
+	if cfg.StripSetCookie || cfg.RewriteLocation {
+		ms = append(ms, middleware.RewriteHeaders(middleware.RewriteOptions{
+			StripSetCookie:  cfg.StripSetCookie,
+			RewriteLocation: cfg.RewriteLocation,
+			OriginHost:      originHost,
+			PublicHost:      publicHost,
+		}))
+	}
+	if cfg.Gzip {
+		ms = append(ms, middleware.Gzip())
+	}
 
-	// Fetch from the dynamic backend
-	resp, err := originReq.Send(ctx, backend.Name())
-	if err != nil {
-		writeJSONErrorWithTarget(w, fsthttp.StatusBadGateway, "Failed to fetch from origin", err.Error(), targetURLParam)
-		return
+	return ms
+}
+
+// queryBool reads a boolean query parameter, defaulting to def when the
+// parameter is absent. "0" and "false" (case-insensitive) are the only
+// recognized ways to turn a default-on flag off.
+func queryBool(u *url.URL, name string, def bool) bool {
+	v := u.Query().Get(name)
+	if v == "" {
+		return def
 	}
+	return v != "0" && !strings.EqualFold(v, "false")
+}
 
-	// Copy response headers
-	for name, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(name, value)
-		}
+// clientIP returns the immediate client's address, preferring the
+// Fastly-Client-IP header Fastly sets at the edge over the request's raw
+// remote address.
+func clientIP(r *fsthttp.Request) string {
+	if ip := r.Header.Get("Fastly-Client-IP"); ip != "" {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// incomingHost returns the Host the client connected to, used to populate
+// X-Forwarded-Host and Forwarded's host= field.
+func incomingHost(r *fsthttp.Request, reqURL *url.URL) string {
+	if h := r.Header.Get("Host"); h != "" {
+		return h
 	}
+	return reqURL.Host
+}
 
-	// Write status code and body
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+// incomingScheme returns the scheme the client used to reach this service.
+// Compute@Edge services are reached over https; reqURL.Scheme is only
+// populated when the parsed request URL happens to carry one.
+func incomingScheme(reqURL *url.URL) string {
+	if reqURL.Scheme != "" {
+		return reqURL.Scheme
+	}
+	return "https"
 }
 
 func writeJSONError(w fsthttp.ResponseWriter, status int, errorMsg, details string) {
@@ -246,6 +497,41 @@ func writeJSONError(w fsthttp.ResponseWriter, status int, errorMsg, details stri
 	})
 }
 
+// writeRateLimitedError renders the 429 response for a request that the
+// limiter either queued-then-timed-out or rejected outright, including a
+// Retry-After hint and the current queue depth so well-behaved clients can
+// back off intelligently.
+func writeRateLimitedError(w fsthttp.ResponseWriter, err error, status limiter.Status) {
+	msg := "Too many concurrent requests for this backend and API key"
+	if errors.Is(err, limiter.ErrQueueTimeout) {
+		msg = "Timed out waiting for a free slot for this backend and API key"
+	}
+
+	w.Header().Set("Retry-After", "1")
+	w.Header().Set("X-RateLimit-Remaining", "0")
+	w.Header().Set("X-Queue-Depth", strconv.Itoa(status.QueueDepth))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(fsthttp.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":   "Rate limited",
+		"message": msg,
+	})
+}
+
+// writePolicyDeniedError renders the structured 403 for a host rejected by
+// the allow/deny policy, as distinct from writeJSONError's generic shape so
+// callers can distinguish "blocked by policy" from "blocked as private
+// host" programmatically via the reason field.
+func writePolicyDeniedError(w fsthttp.ResponseWriter, hostname string, decision policy.Decision) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(fsthttp.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":  "Forbidden",
+		"reason": decision.Reason,
+		"host":   hostname,
+	})
+}
+
 func writeJSONErrorWithTarget(w fsthttp.ResponseWriter, status int, errorMsg, details, target string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)